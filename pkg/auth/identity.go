@@ -0,0 +1,48 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import "context"
+
+type actorContextKey struct{}
+
+// Actor identifies the authenticated caller behind a request by subject and
+// issuer. RequestVerifier.Authenticate attaches one to the request context
+// of a signed request; JWTMiddleware does not attach one.
+type Actor struct {
+	Subject string
+	Issuer  string
+}
+
+// String returns a key that uniquely identifies this Actor across issuers,
+// suitable for use by actor-keyed session registries downstream.
+func (a Actor) String() string {
+	return a.Issuer + "|" + a.Subject
+}
+
+// NewContext returns a copy of ctx carrying actor, for downstream handlers
+// to retrieve via ActorFromContext.
+func NewContext(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the Actor attached to ctx by NewContext, if any.
+func ActorFromContext(ctx context.Context) (Actor, bool) {
+	actor, ok := ctx.Value(actorContextKey{}).(Actor)
+	return actor, ok
+}
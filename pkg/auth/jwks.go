@@ -0,0 +1,212 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+var ErrJWKSUnavailable = errors.New("JWKS is unavailable")
+
+// JWKSKeyStore is a KeysStoreInterface implementation that serves keys from
+// a hosted JWK Set, selected by "kid" rather than by issuer. An admin
+// rotates a user's key by publishing a new JWK entry under their kid,
+// without editing the MysqlKeyStore table.
+//
+// Exactly one of Path or URL should be set: Path loads the set from disk
+// and reloads it whenever its mtime changes, URL fetches it over HTTPS and
+// revalidates with the previous response's ETag.
+type JWKSKeyStore struct {
+	Path string
+	URL  string
+	// AccessLevels maps a kid to the AccessLevel granted to its owner.
+	AccessLevels map[string]int
+	HTTPClient   *http.Client
+
+	mu      sync.RWMutex
+	keys    map[string]jose.JSONWebKey
+	modTime time.Time
+	etag    string
+}
+
+func (s *JWKSKeyStore) New(cfg map[string]string) {
+	if s.Path == "" {
+		s.Path = cfg["path"]
+	}
+	if s.URL == "" {
+		s.URL = cfg["url"]
+	}
+}
+
+// Get returns the key published under the kid passed as args[0].
+func (s *JWKSKeyStore) Get(args ...interface{}) (KeyInstance, error) {
+	if len(args) == 0 {
+		return KeyInstance{}, ErrKeyNotFound
+	}
+	kid, ok := args[0].(string)
+	if !ok {
+		return KeyInstance{}, ErrKeyNotFound
+	}
+
+	if err := s.refresh(); err != nil {
+		return KeyInstance{}, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[kid]
+	if !ok {
+		return KeyInstance{}, ErrKeyNotFound
+	}
+
+	return KeyInstance{
+		Key:         key.Key,
+		Algorithm:   key.Algorithm,
+		AccessLevel: s.AccessLevels[kid],
+	}, nil
+}
+
+func (s *JWKSKeyStore) GetAll() (interface{}, error) {
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys, nil
+}
+
+func (s *JWKSKeyStore) Insert(...string) error {
+	return ErrMethodNotImplemented
+}
+
+func (s *JWKSKeyStore) Update(...string) error {
+	return ErrMethodNotImplemented
+}
+
+func (s *JWKSKeyStore) Delete(...interface{}) error {
+	return ErrMethodNotImplemented
+}
+
+func (s *JWKSKeyStore) refresh() error {
+	switch {
+	case s.Path != "":
+		return s.refreshFromDisk()
+	case s.URL != "":
+		return s.refreshFromURL()
+	default:
+		return ErrJWKSUnavailable
+	}
+}
+
+// refreshFromDisk reloads the JWK Set from Path if its mtime has advanced
+// since the last load.
+func (s *JWKSKeyStore) refreshFromDisk() error {
+	info, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	stale := info.ModTime().After(s.modTime)
+	s.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+
+	s.store(set, info.ModTime(), "")
+	return nil
+}
+
+// refreshFromURL re-fetches the JWK Set over HTTPS, sending the previously
+// seen ETag so an unchanged set costs only a 304 round trip.
+func (s *JWKSKeyStore) refreshFromURL() error {
+	if s.HTTPClient == nil {
+		s.HTTPClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	etag := s.etag
+	s.mu.RUnlock()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ErrJWKSUnavailable
+	}
+
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	s.store(set, time.Time{}, resp.Header.Get("ETag"))
+	return nil
+}
+
+func (s *JWKSKeyStore) store(set jose.JSONWebKeySet, modTime time.Time, etag string) {
+	keys := make(map[string]jose.JSONWebKey, len(set.Keys))
+	for _, k := range set.Keys {
+		keys[k.KeyID] = k
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys = keys
+	if !modTime.IsZero() {
+		s.modTime = modTime
+	}
+	if etag != "" {
+		s.etag = etag
+	}
+}
@@ -0,0 +1,212 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// newTestMiddleware returns a JWTMiddleware wired to keyStore, with its own
+// self-signed RSA keypair used only for session tokens (unrelated to the
+// AuthorisedKeys being exercised by the test).
+func newTestMiddleware(t *testing.T, keyStore KeysStoreInterface) *JWTMiddleware {
+	t.Helper()
+
+	sessionKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating session key: %v", err)
+	}
+
+	m := &JWTMiddleware{
+		SigningAlgorithm: "RS256",
+		PubKey:           &sessionKey.PublicKey,
+		PrivKey:          sessionKey,
+		AuthorisedKeys:   keyStore,
+		AuthnTimeout:     time.Minute,
+		Leeway:           time.Second,
+	}
+	if err := m.MiddlewareInit(); err != nil {
+		t.Fatalf("MiddlewareInit: %v", err)
+	}
+
+	return m
+}
+
+func writeJWKS(t *testing.T, path string, keys ...jose.JSONWebKey) {
+	t.Helper()
+
+	data, err := json.Marshal(jose.JSONWebKeySet{Keys: keys})
+	if err != nil {
+		t.Fatalf("marshalling JWKS: %v", err)
+	}
+	if err := ioutil.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("writing JWKS: %v", err)
+	}
+}
+
+func signAuthnToken(t *testing.T, alg jose.SignatureAlgorithm, key interface{}, kid string) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, &jose.SignerOptions{
+		ExtraHeaders: map[jose.HeaderKey]interface{}{"kid": kid},
+	})
+	if err != nil {
+		t.Fatalf("creating signer: %v", err)
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(30 * time.Second)),
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatalf("signing token: %v", err)
+	}
+	return token
+}
+
+func TestValidateAuthnRequestRSAKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	jwksPath := filepath.Join(dir, "jwks.json")
+
+	firstKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	writeJWKS(t, jwksPath, jose.JSONWebKey{
+		Key: &firstKey.PublicKey, KeyID: "user-1", Algorithm: "RS256", Use: "sig",
+	})
+
+	m := newTestMiddleware(t, &JWKSKeyStore{Path: jwksPath})
+
+	token := signAuthnToken(t, jose.RS256, firstKey, "user-1")
+	key, err := m.ValidateAuthnRequest(token)
+	if err != nil {
+		t.Fatalf("ValidateAuthnRequest: %v", err)
+	}
+	if key == nil {
+		t.Fatal("expected the token signed with the published key to validate")
+	}
+
+	// Rotate: publish a new key under the same kid, as an admin would to
+	// revoke the old one, without touching any database table.
+	secondKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating rotated key: %v", err)
+	}
+	writeJWKS(t, jwksPath, jose.JSONWebKey{
+		Key: &secondKey.PublicKey, KeyID: "user-1", Algorithm: "RS256", Use: "sig",
+	})
+	// Ensure the reload sees a newer mtime regardless of filesystem
+	// timestamp granularity.
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(jwksPath, future, future); err != nil {
+		t.Fatalf("touching JWKS mtime: %v", err)
+	}
+
+	oldToken := signAuthnToken(t, jose.RS256, firstKey, "user-1")
+	if key, err := m.ValidateAuthnRequest(oldToken); err == nil && key != nil {
+		t.Fatal("expected a token signed with the rotated-out key to be rejected")
+	}
+
+	newToken := signAuthnToken(t, jose.RS256, secondKey, "user-1")
+	key, err = m.ValidateAuthnRequest(newToken)
+	if err != nil {
+		t.Fatalf("ValidateAuthnRequest after rotation: %v", err)
+	}
+	if key == nil {
+		t.Fatal("expected the token signed with the rotated-in key to validate")
+	}
+}
+
+func TestValidateAuthnRequestECDSAKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	jwksPath := filepath.Join(dir, "jwks.json")
+
+	firstKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	writeJWKS(t, jwksPath, jose.JSONWebKey{
+		Key: &firstKey.PublicKey, KeyID: "user-2", Algorithm: "ES256", Use: "sig",
+	})
+
+	m := newTestMiddleware(t, &JWKSKeyStore{Path: jwksPath})
+
+	token := signAuthnToken(t, jose.ES256, firstKey, "user-2")
+	if _, err := m.ValidateAuthnRequest(token); err != nil {
+		t.Fatalf("ValidateAuthnRequest: %v", err)
+	}
+
+	secondKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating rotated key: %v", err)
+	}
+	writeJWKS(t, jwksPath, jose.JSONWebKey{
+		Key: &secondKey.PublicKey, KeyID: "user-2", Algorithm: "ES256", Use: "sig",
+	})
+	future := time.Now().Add(time.Second)
+	if err := os.Chtimes(jwksPath, future, future); err != nil {
+		t.Fatalf("touching JWKS mtime: %v", err)
+	}
+
+	newToken := signAuthnToken(t, jose.ES256, secondKey, "user-2")
+	key, err := m.ValidateAuthnRequest(newToken)
+	if err != nil {
+		t.Fatalf("ValidateAuthnRequest after rotation: %v", err)
+	}
+	if key == nil {
+		t.Fatal("expected the token signed with the rotated-in key to validate")
+	}
+}
+
+func TestValidateAuthnRequestRejectsAlgorithmMismatch(t *testing.T) {
+	dir := t.TempDir()
+	jwksPath := filepath.Join(dir, "jwks.json")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	// The JWK declares RS256, but the token below is signed RS384.
+	writeJWKS(t, jwksPath, jose.JSONWebKey{
+		Key: &key.PublicKey, KeyID: "user-3", Algorithm: "RS256", Use: "sig",
+	})
+
+	m := newTestMiddleware(t, &JWKSKeyStore{Path: jwksPath})
+
+	token := signAuthnToken(t, jose.RS384, key, "user-3")
+	if _, err := m.ValidateAuthnRequest(token); err != ErrAlgMismatch {
+		t.Fatalf("expected ErrAlgMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+)
+
+// parseRSAPublicKeyFromPEM decodes a PEM-encoded RSA public key, accepting
+// both PKIX ("PUBLIC KEY") and PKCS#1 ("RSA PUBLIC KEY") encodings.
+func parseRSAPublicKeyFromPEM(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrMissingPubKey
+	}
+
+	if pub, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if key, ok := pub.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+		return nil, ErrInvalidAlg
+	}
+
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+// parseECPublicKeyFromPEM decodes a PEM-encoded, PKIX-wrapped ECDSA public
+// key.
+func parseECPublicKeyFromPEM(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrMissingPubKey
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, ErrInvalidAlg
+	}
+	return key, nil
+}
+
+// parseRSAPrivateKeyFromPEM decodes a PEM-encoded RSA private key,
+// accepting both PKCS#1 and PKCS#8 encodings.
+func parseRSAPrivateKeyFromPEM(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrMissingPrivKey
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrInvalidAlg
+	}
+	return rsaKey, nil
+}
+
+// parseECPrivateKeyFromPEM decodes a PEM-encoded, SEC1 ECDSA private key.
+func parseECPrivateKeyFromPEM(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrMissingPrivKey
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
@@ -19,15 +19,15 @@ package auth
 
 import (
 	"errors"
-	"github.com/SermoDigital/jose/crypto"
-	"github.com/SermoDigital/jose/jws"
-	"github.com/SermoDigital/jose/jwt"
-	"gopkg.in/go-playground/validator.v9"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"gopkg.in/go-playground/validator.v9"
 )
 
 type JWTMiddleware struct {
@@ -47,6 +47,10 @@ type JWTMiddleware struct {
 	InterfaceConfig map[string]string
 	// An AuthorisedKeyInterface instance
 	AuthorisedKeys KeysStoreInterface
+	// OIDC, when set, allows this middleware to additionally accept ID
+	// tokens issued by an external OpenID Connect identity provider,
+	// alongside whatever AuthorisedKeys already accepts.
+	OIDC           *OIDCProvider
 	CookieName     string
 	AuthnTimeout   time.Duration
 	SessionTimeout time.Duration
@@ -65,7 +69,16 @@ type KeysStoreInterface interface {
 }
 
 type KeyInstance struct {
-	Key         string
+	// Key is the credential material for this instance. For stores backing
+	// JWT verification (MysqlKeyStore, JWKSKeyStore) it is a parsed
+	// *rsa.PublicKey or *ecdsa.PublicKey; stores like OIDCKeyStore that
+	// perform their own verification upstream may use it to hold an opaque
+	// identifier instead.
+	Key interface{}
+	// Algorithm, when non-empty, is the signing algorithm this key was
+	// published for. ValidateAuthnRequest rejects tokens whose header
+	// "alg" disagrees with it.
+	Algorithm   string
 	AccessLevel int
 }
 
@@ -83,25 +96,37 @@ var (
 	ErrMissingPrivKey       = errors.New("private key is required")
 	ErrInvalidExpDuration   = errors.New("expiration is longer than the permitted duration")
 	ErrInvalidToken         = errors.New("invalid JWT")
+	ErrAlgMismatch          = errors.New("token algorithm does not match the key's declared algorithm")
 )
 
-// MiddlewareInit is responsible for the setting up of the authentication
-// middleware.
-func (m *JWTMiddleware) MiddlewareInit() error {
-	switch strings.ToUpper(m.SigningAlgorithm) {
+// signatureAlgorithm maps a configured SigningAlgorithm onto the
+// corresponding jose.SignatureAlgorithm.
+func signatureAlgorithm(alg string) (jose.SignatureAlgorithm, error) {
+	switch strings.ToUpper(alg) {
 	case "RS256":
+		return jose.RS256, nil
 	case "RS384":
+		return jose.RS384, nil
 	case "RS512":
+		return jose.RS512, nil
 	case "ES256":
+		return jose.ES256, nil
 	case "ES384":
+		return jose.ES384, nil
 	case "ES512":
-		break
-	case "HS256":
-	case "HS384":
-	case "HS512":
-		return ErrHMACAlg
+		return jose.ES512, nil
+	case "HS256", "HS384", "HS512":
+		return "", ErrHMACAlg
 	default:
-		return ErrInvalidAlg
+		return "", ErrInvalidAlg
+	}
+}
+
+// MiddlewareInit is responsible for the setting up of the authentication
+// middleware.
+func (m *JWTMiddleware) MiddlewareInit() error {
+	if _, err := signatureAlgorithm(m.SigningAlgorithm); err != nil {
+		return err
 	}
 
 	if m.PubKeyPath != "" && m.PubKey == nil {
@@ -145,6 +170,17 @@ func (m *JWTMiddleware) MiddlewareInit() error {
 		m.AuthorisedKeys.New(m.InterfaceConfig)
 	}
 
+	if m.OIDC != nil {
+		if err := m.OIDC.init(); err != nil {
+			return err
+		}
+
+		m.OIDC.keyStore = NewOIDCKeyStore(m.OIDC)
+		m.AuthorisedKeys = &multiKeyStore{
+			stores: []KeysStoreInterface{m.AuthorisedKeys, m.OIDC.keyStore},
+		}
+	}
+
 	m.Validator = validator.New()
 	if err := m.Validator.RegisterValidation(
 		"uniqueIdentity",
@@ -164,98 +200,109 @@ func (m *JWTMiddleware) MiddlewareInit() error {
 	return nil
 }
 
-// ValidateAuthnRequest validates authentication request for a validly signed JWT
+// ValidateAuthnRequest validates authentication request for a validly
+// signed JWT. The verification key is selected by the "kid" header rather
+// than the token's issuer, so an admin can rotate a user's key by
+// publishing a new JWK entry under the same kid without editing the
+// underlying key store.
 func (m *JWTMiddleware) ValidateAuthnRequest(t string) (interface{}, error) {
 	log.Printf(
 		"[INFO] Validating authentication token \"%s\"\n",
 		t,
 	)
 
-	token, err := jws.ParseJWT([]byte(t))
+	token, err := jwt.ParseSigned(t)
 	if err != nil {
 		return nil, ErrInvalidToken
 	}
+	if len(token.Headers) == 0 || token.Headers[0].KeyID == "" {
+		return nil, ErrInvalidToken
+	}
 
-	claims := token.Claims()
-	issuer := claims.Get("iss")
-	log.Printf("[INFO] Parsed authentication token from %s", issuer)
-
-	validate := jws.NewValidator(
-		jws.Claims{},
-		m.Leeway,
-		m.Leeway,
-		func(claims jws.Claims) error {
-			exp := time.Unix(claims.Get("exp").(int64), 0)
-			iat := time.Unix(claims.Get("iat").(int64), 0)
-
-			expectedExp := iat.Add(m.AuthnTimeout)
-			if expectedExp.Before(exp) {
-				return ErrInvalidExpDuration
-			}
+	kid := token.Headers[0].KeyID
+	log.Printf("[INFO] Parsed authentication token for key \"%s\"", kid)
 
-			return nil
-		},
-	)
-
-	key, err := m.AuthorisedKeys.Get(issuer)
+	key, err := m.AuthorisedKeys.Get(kid)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
 	if key == (KeyInstance{}) {
 		return nil, nil
 	}
-	if err != nil {
+
+	if key.Algorithm != "" && key.Algorithm != token.Headers[0].Algorithm {
+		log.Print(ErrAlgMismatch)
+		return nil, ErrAlgMismatch
+	}
+
+	var claims jwt.Claims
+	if err := token.Claims(key.Key, &claims); err != nil {
 		log.Print(err)
-		return nil, err
+		return nil, nil
 	}
 
-	err = token.Validate(
-		key.Key,
-		jws.GetSigningMethod(m.SigningAlgorithm),
-		validate,
-	)
-	if err != nil {
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, m.Leeway); err != nil {
 		log.Print(err)
 		return nil, nil
 	}
 
+	if claims.IssuedAt != nil && claims.Expiry != nil {
+		expectedExp := claims.IssuedAt.Time().Add(m.AuthnTimeout)
+		if expectedExp.Before(claims.Expiry.Time()) {
+			return nil, ErrInvalidExpDuration
+		}
+	}
+
 	return key, nil
 }
 
+// sessionClaims is the claim set carried by session tokens minted by
+// GetSessionToken.
+type sessionClaims struct {
+	jwt.Claims
+	User interface{} `json:"user,omitempty"`
+}
+
 // GetSessionToken generate session token, in the form of a valid JWT signed
 // using the server's private key.
 func (m *JWTMiddleware) GetSessionToken(data interface{}) (string, error) {
-	now := time.Now()
-
-	claim := jws.Claims{}
-	claim.SetIssuedAt(now)
-	claim.SetNotBefore(now)
-	claim.SetExpiration(now.Add(m.SessionTimeout))
-	claim.Set("user", data)
+	alg, err := signatureAlgorithm(m.SigningAlgorithm)
+	if err != nil {
+		return "", err
+	}
 
-	token := jws.NewJWT(claim, jws.GetSigningMethod(m.SigningAlgorithm))
-	bytes, err := token.Serialize(m.PrivKey)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: m.PrivKey}, nil)
 	if err != nil {
 		return "", err
 	}
 
-	return string(bytes[:]), nil
+	now := time.Now()
+	claims := sessionClaims{
+		Claims: jwt.Claims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(m.SessionTimeout)),
+		},
+		User: data,
+	}
+
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
 }
 
 // ValidateSessionToken validates the validity of the JWT token.
-func (m *JWTMiddleware) ValidateSessionToken(t jwt.JWT) (bool, error) {
-	validate := jws.NewValidator(
-		jws.Claims{},
-		m.Leeway,
-		m.Leeway,
-		func(claims jws.Claims) error {
-			return nil
-		},
-	)
-
-	err := t.Validate(
-		m.PubKey,
-		jws.GetSigningMethod(m.SigningAlgorithm),
-		validate,
-	)
+func (m *JWTMiddleware) ValidateSessionToken(t string) (bool, error) {
+	token, err := jwt.ParseSigned(t)
 	if err != nil {
+		return false, ErrInvalidToken
+	}
+
+	var claims sessionClaims
+	if err := token.Claims(m.PubKey, &claims); err != nil {
+		return false, err
+	}
+
+	if err := claims.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, m.Leeway); err != nil {
 		return false, err
 	}
 
@@ -264,14 +311,10 @@ func (m *JWTMiddleware) ValidateSessionToken(t jwt.JWT) (bool, error) {
 
 func (m *JWTMiddleware) parsePublicKey(k []byte) (interface{}, error) {
 	switch strings.ToUpper(m.SigningAlgorithm) {
-	case "RS256":
-	case "RS384":
-	case "RS512":
-		return crypto.ParseRSAPublicKeyFromPEM(k)
-	case "ES256":
-	case "ES384":
-	case "ES512":
-		return crypto.ParseECPublicKeyFromPEM(k)
+	case "RS256", "RS384", "RS512":
+		return parseRSAPublicKeyFromPEM(k)
+	case "ES256", "ES384", "ES512":
+		return parseECPublicKeyFromPEM(k)
 	}
 
 	return nil, ErrInvalidAlg
@@ -279,14 +322,10 @@ func (m *JWTMiddleware) parsePublicKey(k []byte) (interface{}, error) {
 
 func (m *JWTMiddleware) parsePrivateKey(k []byte) (interface{}, error) {
 	switch strings.ToUpper(m.SigningAlgorithm) {
-	case "RS256":
-	case "RS384":
-	case "RS512":
-		return crypto.ParseRSAPrivateKeyFromPEM(k)
-	case "ES256":
-	case "ES384":
-	case "ES512":
-		return crypto.ParseECPrivateKeyFromPEM(k)
+	case "RS256", "RS384", "RS512":
+		return parseRSAPrivateKeyFromPEM(k)
+	case "ES256", "ES384", "ES512":
+		return parseECPrivateKeyFromPEM(k)
 	}
 
 	return nil, ErrInvalidAlg
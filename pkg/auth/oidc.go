@@ -0,0 +1,396 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// defaultJWKSCacheDuration is used when a JWKS response carries no
+// Cache-Control max-age directive.
+const defaultJWKSCacheDuration = 15 * time.Minute
+
+var (
+	ErrMissingIssuer   = errors.New("OIDC issuer URL is required")
+	ErrInvalidIssuer   = errors.New("ID token issuer does not match the configured OIDC provider")
+	ErrInvalidAudience = errors.New("ID token audience does not match the configured OIDC provider")
+	ErrMissingSubject  = errors.New("ID token is missing a subject claim")
+)
+
+// OIDCProvider federates JWTMiddleware with an external OpenID Connect
+// identity provider, as an alternative (or complement) to the
+// self-registered per-user public keys in JWTMiddleware.AuthorisedKeys.
+type OIDCProvider struct {
+	// IssuerURL is the OIDC issuer. Discovery is performed against
+	// IssuerURL + "/.well-known/openid-configuration".
+	IssuerURL string
+	// Audience is the expected "aud" claim of incoming ID tokens. Left
+	// empty, the audience is not checked.
+	Audience string
+	// SubjectClaim names the claim mapped to KeyInstance.Key. Defaults to
+	// "sub".
+	SubjectClaim string
+	// AccessLevelClaim names the claim (e.g. "groups" or "roles") used to
+	// derive KeyInstance.AccessLevel via AccessLevels.
+	AccessLevelClaim string
+	// AccessLevels maps a single value of AccessLevelClaim to the access
+	// level granted to an actor carrying it. When an ID token's claim
+	// lists several values, the highest matching access level wins.
+	AccessLevels map[string]int
+
+	HTTPClient *http.Client
+
+	mu            sync.RWMutex
+	discovery     oidcDiscoveryDocument
+	jwks          map[string]jose.JSONWebKey
+	jwksExpiresAt time.Time
+
+	keyStore *OIDCKeyStore
+}
+
+type oidcDiscoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// init performs OIDC discovery and the initial JWKS fetch.
+func (p *OIDCProvider) init() error {
+	if p.IssuerURL == "" {
+		return ErrMissingIssuer
+	}
+	if p.HTTPClient == nil {
+		p.HTTPClient = http.DefaultClient
+	}
+	if p.SubjectClaim == "" {
+		p.SubjectClaim = "sub"
+	}
+
+	if err := p.discover(); err != nil {
+		return err
+	}
+	return p.refreshJWKS()
+}
+
+// discover fetches and caches the provider's discovery document.
+func (p *OIDCProvider) discover() error {
+	resp, err := p.HTTPClient.Get(strings.TrimRight(p.IssuerURL, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var doc oidcDiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.discovery = doc
+	p.mu.Unlock()
+	return nil
+}
+
+// refreshJWKS fetches the provider's JWKS and caches it until the JWKS
+// response's Cache-Control max-age (or defaultJWKSCacheDuration) elapses.
+func (p *OIDCProvider) refreshJWKS() error {
+	p.mu.RLock()
+	uri := p.discovery.JWKSURI
+	p.mu.RUnlock()
+
+	resp, err := p.HTTPClient.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]jose.JSONWebKey, len(set.Keys))
+	for _, k := range set.Keys {
+		keys[k.KeyID] = k
+	}
+
+	p.mu.Lock()
+	p.jwks = keys
+	p.jwksExpiresAt = time.Now().Add(jwksCacheMaxAge(resp.Header))
+	p.mu.Unlock()
+	return nil
+}
+
+// jwksCacheMaxAge reads the max-age directive off a JWKS response's
+// Cache-Control header, falling back to defaultJWKSCacheDuration.
+func jwksCacheMaxAge(h http.Header) time.Duration {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds := strings.TrimPrefix(directive, "max-age=")
+			if n, err := strconv.Atoi(seconds); err == nil {
+				return time.Duration(n) * time.Second
+			}
+		}
+	}
+
+	return defaultJWKSCacheDuration
+}
+
+// key returns the JWK for kid, transparently refreshing the JWKS cache if
+// it is stale or the key is unknown.
+func (p *OIDCProvider) key(kid string) (jose.JSONWebKey, error) {
+	p.mu.RLock()
+	key, ok := p.jwks[kid]
+	stale := time.Now().After(p.jwksExpiresAt)
+	p.mu.RUnlock()
+
+	if !ok || stale {
+		if err := p.refreshJWKS(); err != nil {
+			return jose.JSONWebKey{}, err
+		}
+
+		p.mu.RLock()
+		key, ok = p.jwks[kid]
+		p.mu.RUnlock()
+	}
+
+	if !ok {
+		return jose.JSONWebKey{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+// issuer returns the issuer to validate the "iss" claim against, preferring
+// the value the discovery document itself reports.
+func (p *OIDCProvider) issuer() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.discovery.Issuer != "" {
+		return p.discovery.Issuer
+	}
+	return p.IssuerURL
+}
+
+// ValidateIDToken verifies an incoming ID token against this provider's
+// JWKS, checking iss/aud/exp/nbf with the middleware's configured Leeway,
+// and maps its subject (or SubjectClaim) and access-level claim to a
+// KeyInstance. The result is cached so KeysStoreInterface.Get can resolve
+// the same actor afterwards without re-verifying the token.
+func (p *OIDCProvider) ValidateIDToken(m *JWTMiddleware, t string) (KeyInstance, error) {
+	token, err := jwt.ParseSigned(t)
+	if err != nil {
+		return KeyInstance{}, ErrInvalidToken
+	}
+	if len(token.Headers) == 0 || token.Headers[0].Algorithm == "" {
+		return KeyInstance{}, ErrInvalidAlg
+	}
+
+	jwk, err := p.key(token.Headers[0].KeyID)
+	if err != nil {
+		return KeyInstance{}, err
+	}
+	if jwk.Algorithm != "" && jwk.Algorithm != token.Headers[0].Algorithm {
+		return KeyInstance{}, ErrAlgMismatch
+	}
+
+	var registered jwt.Claims
+	var extra map[string]interface{}
+	if err := token.Claims(jwk.Key, &registered, &extra); err != nil {
+		log.Print(err)
+		return KeyInstance{}, ErrInvalidToken
+	}
+
+	if registered.Issuer != p.issuer() {
+		return KeyInstance{}, ErrInvalidIssuer
+	}
+	// Audience is a string or, per the JWT spec, an array of strings;
+	// jwt.Audience's JSON unmarshalling already accepts both forms.
+	if p.Audience != "" && !registered.Audience.Contains(p.Audience) {
+		return KeyInstance{}, ErrInvalidAudience
+	}
+
+	if err := registered.ValidateWithLeeway(jwt.Expected{Time: time.Now()}, m.Leeway); err != nil {
+		log.Print(err)
+		return KeyInstance{}, ErrInvalidToken
+	}
+
+	subjectClaim := p.SubjectClaim
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+
+	subject := registered.Subject
+	if subjectClaim != "sub" {
+		subject, _ = extra[subjectClaim].(string)
+	}
+	if subject == "" {
+		return KeyInstance{}, ErrMissingSubject
+	}
+
+	instance := KeyInstance{Key: subject, AccessLevel: p.accessLevel(extra)}
+	if p.keyStore != nil {
+		p.keyStore.put(subject, instance)
+	}
+
+	return instance, nil
+}
+
+// accessLevel derives an AccessLevel from AccessLevelClaim, taking the
+// highest level among any matching values when the claim is a list.
+func (p *OIDCProvider) accessLevel(claims map[string]interface{}) int {
+	if p.AccessLevelClaim == "" {
+		return 0
+	}
+
+	level := 0
+	switch v := claims[p.AccessLevelClaim].(type) {
+	case string:
+		if l, ok := p.AccessLevels[v]; ok && l > level {
+			level = l
+		}
+	case []interface{}:
+		for _, raw := range v {
+			s, ok := raw.(string)
+			if !ok {
+				continue
+			}
+			if l, ok := p.AccessLevels[s]; ok && l > level {
+				level = l
+			}
+		}
+	}
+
+	return level
+}
+
+// OIDCKeyStore is a KeysStoreInterface backed by the subject cache an
+// OIDCProvider populates as it validates ID tokens, letting code that only
+// knows how to call KeysStoreInterface.Get resolve OIDC-authenticated
+// actors the same way it resolves self-registered pubkey users.
+type OIDCKeyStore struct {
+	provider *OIDCProvider
+
+	mu    sync.RWMutex
+	cache map[string]KeyInstance
+}
+
+// NewOIDCKeyStore returns an OIDCKeyStore fed by provider.
+func NewOIDCKeyStore(provider *OIDCProvider) *OIDCKeyStore {
+	return &OIDCKeyStore{provider: provider, cache: make(map[string]KeyInstance)}
+}
+
+func (s *OIDCKeyStore) New(map[string]string) {}
+
+// Get looks up the KeyInstance cached for the subject passed as args[0].
+func (s *OIDCKeyStore) Get(args ...interface{}) (KeyInstance, error) {
+	if len(args) == 0 {
+		return KeyInstance{}, ErrKeyNotFound
+	}
+
+	subject, ok := args[0].(string)
+	if !ok {
+		return KeyInstance{}, ErrKeyNotFound
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.cache[subject]
+	if !ok {
+		return KeyInstance{}, ErrKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *OIDCKeyStore) GetAll() (interface{}, error) {
+	return nil, ErrMethodNotImplemented
+}
+
+func (s *OIDCKeyStore) Insert(...string) error {
+	return ErrMethodNotImplemented
+}
+
+func (s *OIDCKeyStore) Update(...string) error {
+	return ErrMethodNotImplemented
+}
+
+func (s *OIDCKeyStore) Delete(...interface{}) error {
+	return ErrMethodNotImplemented
+}
+
+func (s *OIDCKeyStore) put(subject string, key KeyInstance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache[subject] = key
+}
+
+// multiKeyStore queries a series of KeysStoreInterface implementations in
+// order, returning the first match. It lets MiddlewareInit accept
+// self-registered pubkeys and OIDC federation concurrently.
+type multiKeyStore struct {
+	stores []KeysStoreInterface
+}
+
+func (m *multiKeyStore) New(cfg map[string]string) {
+	for _, s := range m.stores {
+		s.New(cfg)
+	}
+}
+
+func (m *multiKeyStore) Get(args ...interface{}) (KeyInstance, error) {
+	var lastErr error
+	for _, s := range m.stores {
+		key, err := s.Get(args...)
+		if err == nil {
+			return key, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return KeyInstance{}, lastErr
+	}
+	return KeyInstance{}, ErrKeyNotFound
+}
+
+func (m *multiKeyStore) GetAll() (interface{}, error) {
+	return nil, ErrMethodNotImplemented
+}
+
+func (m *multiKeyStore) Insert(args ...string) error {
+	return m.stores[0].Insert(args...)
+}
+
+func (m *multiKeyStore) Update(args ...string) error {
+	return m.stores[0].Update(args...)
+}
+
+func (m *multiKeyStore) Delete(args ...interface{}) error {
+	return m.stores[0].Delete(args...)
+}
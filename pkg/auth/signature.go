@@ -0,0 +1,457 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSignedHeaders is the "headers" parameter RequestSigner advertises.
+const defaultSignedHeaders = "(request-target) date digest x-request-nonce"
+
+// requiredSignedHeaders are the components a request's "headers" parameter
+// must cover for RequestVerifier to accept it. Without this, a signer could
+// advertise a narrower "headers" list (e.g. omitting "digest") and leave the
+// body or nonce outside the signed scope, letting them be swapped after
+// signing without invalidating the signature.
+var requiredSignedHeaders = []string{"(request-target)", "date", "digest", "x-request-nonce"}
+
+// minNonceRetention bounds nonceCache memory use when a RequestVerifier is
+// constructed with no MaxSkew.
+const minNonceRetention = 5 * time.Minute
+
+// nonceRetention returns how long a RequestVerifier must remember a nonce.
+// Authenticate accepts any Date within maxSkew of either side of now, so a
+// future-dated request (the case maxSkew exists for) isn't rejected until
+// its Date is up to maxSkew in the past - the nonce must therefore survive
+// up to 2*maxSkew after it was first seen, not just maxSkew.
+func nonceRetention(maxSkew time.Duration) time.Duration {
+	retention := 2 * maxSkew
+	if retention < minNonceRetention {
+		retention = minNonceRetention
+	}
+	return retention
+}
+
+var (
+	ErrMissingSignature   = errors.New("request is missing a signature")
+	ErrMalformedSignature = errors.New("request signature header is malformed")
+	ErrSignatureExpired   = errors.New("request signature is too old")
+	ErrReplayedNonce      = errors.New("request nonce has already been used")
+	ErrBodyDigestMismatch = errors.New("request body does not match its digest")
+)
+
+// RequestSigner produces a per-request signature for non-browser clients
+// (CLI, automation) calling the management API, as a scriptable
+// alternative to the JWT session cookie that doesn't expand the JWT trust
+// surface: it signs with the same per-user keys KeysStoreInterface already
+// manages.
+type RequestSigner struct {
+	// KeyID identifies the signing key to the verifier, e.g. the key
+	// owner's issuer/subject.
+	KeyID string
+	// Algorithm is one of the SigningAlgorithm values JWTMiddleware
+	// accepts, e.g. "RS256" or "ES256".
+	Algorithm string
+	// PrivateKey is the key material matching KeyID, of type *rsa.PrivateKey
+	// or *ecdsa.PrivateKey.
+	PrivateKey interface{}
+}
+
+// Sign computes a signature over the canonicalized method, request-target
+// (path plus any query string), Date, and a SHA-256 digest of body, and
+// returns the headers the caller must attach to the outgoing request.
+func (s *RequestSigner) Sign(method, path string, body []byte) (http.Header, error) {
+	if _, err := signatureAlgorithm(s.Algorithm); err != nil {
+		return nil, err
+	}
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	digest := bodyDigest(body)
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{
+		"(request-target)": strings.ToLower(method) + " " + path,
+		"date":              date,
+		"digest":            "SHA-256=" + digest,
+		"x-request-nonce":   nonce,
+	}
+
+	signingString, err := canonicalRequest(defaultSignedHeaders, values)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := signRaw(s.Algorithm, s.PrivateKey, []byte(signingString))
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("Date", date)
+	header.Set("Digest", "SHA-256="+digest)
+	header.Set("X-Request-Nonce", nonce)
+	header.Set("Authorization", fmt.Sprintf(
+		`Signature keyId="%s",algorithm="%s",headers="%s",signature="%s"`,
+		s.KeyID,
+		strings.ToLower(s.Algorithm),
+		defaultSignedHeaders,
+		base64.StdEncoding.EncodeToString(signature),
+	))
+
+	return header, nil
+}
+
+// RequestVerifier validates signatures produced by RequestSigner against
+// the same KeysStoreInterface JWTMiddleware uses for the JWT path, rejects
+// stale requests, and deduplicates nonces to defeat replay.
+type RequestVerifier struct {
+	Keys    KeysStoreInterface
+	MaxSkew time.Duration
+
+	once   sync.Once
+	nonces *nonceCache
+}
+
+// NewRequestVerifier returns a RequestVerifier backed by a fresh nonce
+// replay cache, retained for at least 2*maxSkew so a nonce cannot be
+// evicted while its signature is still inside the allowed skew window.
+func NewRequestVerifier(keys KeysStoreInterface, maxSkew time.Duration) *RequestVerifier {
+	return &RequestVerifier{
+		Keys:    keys,
+		MaxSkew: maxSkew,
+		nonces:  newNonceCache(nonceRetention(maxSkew)),
+	}
+}
+
+// replayCache returns v's nonce replay cache, lazily creating one if v was
+// constructed as a struct literal rather than through NewRequestVerifier.
+func (v *RequestVerifier) replayCache() *nonceCache {
+	v.once.Do(func() {
+		if v.nonces == nil {
+			v.nonces = newNonceCache(nonceRetention(v.MaxSkew))
+		}
+	})
+	return v.nonces
+}
+
+// Authenticate verifies r's signature and, on success, returns a copy of r
+// whose context carries the resolved Actor (see ActorFromContext), with the
+// signature's keyId as its Subject and "signature" as its Issuer. The
+// cookie-based session path of JWTMiddleware attaches no Actor. r.Body is
+// restored so callers can still read it afterwards.
+func (v *RequestVerifier) Authenticate(r *http.Request) (*http.Request, error) {
+	params, err := parseSignatureHeader(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+	if err := requireSignedHeaders(params.headers); err != nil {
+		return nil, err
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return nil, ErrMalformedSignature
+	}
+	if v.MaxSkew > 0 {
+		if skew := time.Since(date); skew > v.MaxSkew || skew < -v.MaxSkew {
+			return nil, ErrSignatureExpired
+		}
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	digest := bodyDigest(body)
+	if r.Header.Get("Digest") != "SHA-256="+digest {
+		return nil, ErrBodyDigestMismatch
+	}
+
+	nonce := r.Header.Get("X-Request-Nonce")
+	if nonce == "" || !v.replayCache().addIfAbsent(nonce, time.Now()) {
+		return nil, ErrReplayedNonce
+	}
+
+	key, err := v.Keys.Get(params.keyID)
+	if err != nil {
+		return nil, err
+	}
+	if key == (KeyInstance{}) {
+		return nil, ErrKeyNotFound
+	}
+
+	if _, err := signatureAlgorithm(params.algorithm); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(params.signature)
+	if err != nil {
+		return nil, ErrMalformedSignature
+	}
+
+	values := map[string]string{
+		"(request-target)": strings.ToLower(r.Method) + " " + r.URL.RequestURI(),
+		"date":              r.Header.Get("Date"),
+		"digest":            "SHA-256=" + digest,
+		"x-request-nonce":   nonce,
+	}
+
+	signingString, err := canonicalRequest(params.headers, values)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyRaw(params.algorithm, key.Key, []byte(signingString), signature); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	actor := Actor{Subject: params.keyID, Issuer: "signature"}
+	return r.WithContext(NewContext(r.Context(), actor)), nil
+}
+
+// requireSignedHeaders rejects a "headers" parameter that does not cover
+// every entry in requiredSignedHeaders.
+func requireSignedHeaders(headers string) error {
+	advertised := make(map[string]bool)
+	for _, name := range strings.Fields(headers) {
+		advertised[name] = true
+	}
+
+	for _, required := range requiredSignedHeaders {
+		if !advertised[required] {
+			return ErrMalformedSignature
+		}
+	}
+
+	return nil
+}
+
+// canonicalRequest builds the string RequestSigner and RequestVerifier sign
+// and verify, one line per entry of headers (the "headers" list advertised
+// in the Authorization header), in the order given.
+func canonicalRequest(headers string, values map[string]string) (string, error) {
+	names := strings.Fields(headers)
+	if len(names) == 0 {
+		return "", ErrMalformedSignature
+	}
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		value, ok := values[name]
+		if !ok {
+			return "", ErrMalformedSignature
+		}
+		lines = append(lines, name+": "+value)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// hashForAlgorithm returns the digest algorithm a RequestSigner/
+// RequestVerifier signing algorithm name signs over.
+func hashForAlgorithm(alg string) (crypto.Hash, error) {
+	switch strings.ToUpper(alg) {
+	case "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512", "ES512":
+		return crypto.SHA512, nil
+	default:
+		return 0, ErrInvalidAlg
+	}
+}
+
+// signRaw signs data's digest directly with key, without wrapping it in a
+// JWS envelope: the Authorization header's "signature" parameter carries
+// only this raw signature.
+func signRaw(alg string, key interface{}, data []byte) ([]byte, error) {
+	hash, err := hashForAlgorithm(alg)
+	if err != nil {
+		return nil, err
+	}
+	digest := hashSum(hash, data)
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, k, digest)
+	default:
+		return nil, ErrInvalidAlg
+	}
+}
+
+// verifyRaw verifies a signature produced by signRaw.
+func verifyRaw(alg string, key interface{}, data, signature []byte) error {
+	hash, err := hashForAlgorithm(alg)
+	if err != nil {
+		return err
+	}
+	digest := hashSum(hash, data)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, signature) {
+			return ErrInvalidToken
+		}
+		return nil
+	default:
+		return ErrInvalidAlg
+	}
+}
+
+func hashSum(h crypto.Hash, data []byte) []byte {
+	hasher := h.New()
+	hasher.Write(data)
+	return hasher.Sum(nil)
+}
+
+type signatureParams struct {
+	keyID     string
+	algorithm string
+	headers   string
+	signature string
+}
+
+var signatureParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// parseSignatureHeader parses an `Authorization: Signature ...` header into
+// its keyId/algorithm/headers/signature parameters.
+func parseSignatureHeader(header string) (signatureParams, error) {
+	const prefix = "Signature "
+	if !strings.HasPrefix(header, prefix) {
+		return signatureParams{}, ErrMissingSignature
+	}
+
+	var params signatureParams
+	for _, match := range signatureParamPattern.FindAllStringSubmatch(strings.TrimPrefix(header, prefix), -1) {
+		switch match[1] {
+		case "keyId":
+			params.keyID = match[2]
+		case "algorithm":
+			params.algorithm = match[2]
+		case "headers":
+			params.headers = match[2]
+		case "signature":
+			params.signature = match[2]
+		}
+	}
+
+	if params.keyID == "" || params.algorithm == "" || params.headers == "" || params.signature == "" {
+		return signatureParams{}, ErrMalformedSignature
+	}
+
+	return params, nil
+}
+
+// nonceCache is an in-memory record of recently seen nonces, used to reject
+// replayed signed requests. Entries are retained for at least retention
+// (see nonceRetention) rather than evicted by a fixed count, so a nonce
+// cannot be forgotten while its signature would still pass the skew check.
+type nonceCache struct {
+	mu        sync.Mutex
+	retention time.Duration
+	order     *list.List
+	index     map[string]*list.Element
+}
+
+type nonceCacheEntry struct {
+	nonce string
+	at    time.Time
+}
+
+func newNonceCache(retention time.Duration) *nonceCache {
+	return &nonceCache{
+		retention: retention,
+		order:     list.New(),
+		index:     make(map[string]*list.Element),
+	}
+}
+
+// addIfAbsent records nonce as seen at now and returns true, or returns
+// false if nonce was already recorded within the retention window - i.e.
+// this request is a replay.
+func (c *nonceCache) addIfAbsent(nonce string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictBefore(now.Add(-c.retention))
+
+	if _, ok := c.index[nonce]; ok {
+		return false
+	}
+
+	c.index[nonce] = c.order.PushFront(nonceCacheEntry{nonce: nonce, at: now})
+	return true
+}
+
+func (c *nonceCache) evictBefore(cutoff time.Time) {
+	for {
+		oldest := c.order.Back()
+		if oldest == nil {
+			return
+		}
+
+		entry := oldest.Value.(nonceCacheEntry)
+		if entry.at.After(cutoff) {
+			return
+		}
+
+		c.order.Remove(oldest)
+		delete(c.index, entry.nonce)
+	}
+}
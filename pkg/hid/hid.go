@@ -18,64 +18,105 @@
 package hid
 
 import (
-	"encoding/hex"
-	"fmt"
-	"github.com/gorilla/websocket"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+
+	"github.com/adsisto/adsisto/pkg/auth"
+	"github.com/gorilla/websocket"
 )
 
-// Stream is a instance of HID device.
-type Stream struct {
-	Device string
+var ErrInvalidMessage = errors.New("invalid HID message")
+
+// Device is a HID gadget endpoint a Stream writes reports to. Implementations
+// own the device node path, the report descriptor advertised to the guest,
+// and the decoding of wire messages into raw HID reports.
+type Device interface {
+	// Path returns the gadget device node to write reports to, e.g.
+	// "/dev/hidg0".
+	Path() string
+	// ReportDescriptor returns the USB HID report descriptor the gadget
+	// advertises, so callers can size and register the gadget function.
+	ReportDescriptor() []byte
+	// Decode turns the raw WebSocket message into a HID report ready to be
+	// written to Path. A nil report with a nil error means the message
+	// carried no actionable event.
+	Decode(data []byte) ([]byte, error)
 }
 
-// StreamMessage is a instance of the message to be streamed to the HID device.
-type StreamMessage struct {
-	Key   string
-	Ctrl  bool
-	Shift bool
-	Alt   bool
-	Meta  bool
+// Stream is an instance of a HID device exposed over a WebSocket.
+type Stream struct {
+	Device Device
 }
 
-// WebsocketHandler sets up a WebSocket instance for receiving keystrokes events
-// from the client.
+// WebsocketHandler sets up a WebSocket instance that decodes incoming
+// messages via s.Device and writes the resulting HID reports to the gadget
+// device node.
+//
+// Sessions are tracked per actor, as carried in the request context (see
+// auth.ActorFromContext); a request without one is rejected with 401. If a
+// prior session for the same actor is still active, its context is
+// cancelled, which makes it close its WebSocket and device file and wait
+// for its read loop to return. This session does not wait for that
+// teardown: it starts reading straight away, so a report already in flight
+// in the prior session's loop can still reach the gadget.
 func (s *Stream) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := auth.ActorFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorised", http.StatusUnauthorized)
+		return
+	}
+
 	upgrader := websocket.Upgrader{}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		panic(err)
 	}
+	defer ws.Close()
 
-	file, err := os.Create(s.Device)
+	file, err := os.Create(s.Device.Path())
 	if err != nil {
 		panic(err)
 	}
-
-	defer ws.Close()
 	defer file.Close()
 
-	for {
-		message := StreamMessage{}
-		err := ws.ReadJSON(message)
-		if err != nil {
-			log.Print(err)
-		}
+	ctx, handle := registry.takeOver(actor.String())
+	defer registry.release(actor.String(), handle)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
 
-		message.ParseMessage()
-		if message.Key != "" {
-			bytes := message.GenerateHID()
-			bytesEncoded := hex.EncodeToString(bytes[:])
-			bytesEncoded = strings.Replace(bytesEncoded, "0x", "\\x", -1)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				log.Print(err)
+				return
+			}
 
-			command := fmt.Sprintf("printf \"%%b\" '%v' | hid-ops keyboard", bytesEncoded)
-			_, err = file.Write([]byte(command))
+			report, err := s.Device.Decode(data)
 			if err != nil {
 				log.Print(err)
+				continue
+			}
+			if report == nil {
+				continue
+			}
+
+			if _, err := file.Write(report); err != nil {
+				log.Print(err)
 			}
 		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		// A newer session for the same actor has taken over; tear this one
+		// down so its goroutine and device file don't linger.
+		ws.Close()
+		file.Close()
+		<-done
+	case <-done:
 	}
 }
@@ -0,0 +1,119 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adsisto/adsisto/pkg/auth"
+	"github.com/gorilla/websocket"
+)
+
+// echoDevice is a Device stub that treats every message as an already
+// decoded report, so WebsocketHandler's write to the gadget device node can
+// be observed directly from the bytes a test client sends.
+type echoDevice struct {
+	path string
+}
+
+func (d *echoDevice) Path() string            { return d.path }
+func (d *echoDevice) ReportDescriptor() []byte { return []byte{0x05, 0x01} }
+
+func (d *echoDevice) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// newTestServer starts an httptest server whose handler injects actor into
+// the request context via auth.NewContext, then hands off to
+// stream.WebsocketHandler.
+func newTestServer(stream *Stream, actor auth.Actor) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream.WebsocketHandler(w, r.WithContext(auth.NewContext(r.Context(), actor)))
+	}))
+}
+
+// TestWebsocketHandlerSessionTakeOverClosesPriorConnection drives
+// Stream.WebsocketHandler end-to-end through two real WebSocket
+// connections for the same actor, verifying the first connection's read
+// loop is torn down as soon as the second takes over, and that the second
+// connection's messages still reach the gadget device file.
+func TestWebsocketHandlerSessionTakeOverClosesPriorConnection(t *testing.T) {
+	device := &echoDevice{path: filepath.Join(t.TempDir(), "hidg0")}
+	stream := &Stream{Device: device}
+	actor := auth.Actor{Subject: "subject-1", Issuer: "https://issuer.example"}
+
+	server := newTestServer(stream, actor)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	firstConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dialing first session: %v", err)
+	}
+	defer firstConn.Close()
+
+	firstClosed := make(chan struct{})
+	go func() {
+		defer close(firstClosed)
+		for {
+			if _, _, err := firstConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-firstClosed:
+		t.Fatal("first session was closed before a second session took over")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	secondConn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dialing second session: %v", err)
+	}
+	defer secondConn.Close()
+
+	select {
+	case <-firstClosed:
+	case <-time.After(time.Second):
+		t.Fatal("first session's WebSocket was not closed when the second session took over")
+	}
+
+	if err := secondConn.WriteMessage(websocket.BinaryMessage, []byte("report")); err != nil {
+		t.Fatalf("writing through second session: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, err := ioutil.ReadFile(device.path)
+		if err == nil && string(data) == "report" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gadget device file never received the second session's report, got %q, err %v", data, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
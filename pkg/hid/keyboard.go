@@ -0,0 +1,129 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import "encoding/json"
+
+// StreamMessage is an instance of the message to be streamed to the HID
+// keyboard device.
+type StreamMessage struct {
+	Key   string
+	Ctrl  bool
+	Shift bool
+	Alt   bool
+	Meta  bool
+
+	keyCode byte
+}
+
+// ParseMessage resolves the Key field against the USB HID usage table,
+// populating the internal keycode used by GenerateHID.
+func (m *StreamMessage) ParseMessage() {
+	m.keyCode = keyCodes[m.Key]
+}
+
+// GenerateHID produces a standard 8-byte USB HID boot keyboard report:
+// modifier byte, reserved byte, and up to six simultaneous keycodes.
+func (m *StreamMessage) GenerateHID() [8]byte {
+	var modifier byte
+	if m.Ctrl {
+		modifier |= 0x01
+	}
+	if m.Shift {
+		modifier |= 0x02
+	}
+	if m.Alt {
+		modifier |= 0x04
+	}
+	if m.Meta {
+		modifier |= 0x08
+	}
+
+	return [8]byte{modifier, 0x00, m.keyCode, 0x00, 0x00, 0x00, 0x00, 0x00}
+}
+
+// keyCodes maps a subset of the USB HID keyboard usage table used by
+// clients to report which key was pressed.
+var keyCodes = map[string]byte{
+	"a": 0x04, "b": 0x05, "c": 0x06, "d": 0x07, "e": 0x08, "f": 0x09,
+	"g": 0x0a, "h": 0x0b, "i": 0x0c, "j": 0x0d, "k": 0x0e, "l": 0x0f,
+	"m": 0x10, "n": 0x11, "o": 0x12, "p": 0x13, "q": 0x14, "r": 0x15,
+	"s": 0x16, "t": 0x17, "u": 0x18, "v": 0x19, "w": 0x1a, "x": 0x1b,
+	"y": 0x1c, "z": 0x1d,
+	"1": 0x1e, "2": 0x1f, "3": 0x20, "4": 0x21, "5": 0x22,
+	"6": 0x23, "7": 0x24, "8": 0x25, "9": 0x26, "0": 0x27,
+	"Enter": 0x28, "Escape": 0x29, "Backspace": 0x2a, "Tab": 0x2b,
+	"Space": 0x2c, "ArrowRight": 0x4f, "ArrowLeft": 0x50,
+	"ArrowDown": 0x51, "ArrowUp": 0x52,
+}
+
+// keyboardReportDescriptor is the USB HID report descriptor for a standard
+// boot-protocol keyboard: a modifier byte, a reserved byte, and six keycode
+// bytes.
+var keyboardReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xa1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Keyboard/Keypad)
+	0x19, 0xe0, //   Usage Minimum (0xE0)
+	0x29, 0xe7, //   Usage Maximum (0xE7)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data,Var,Abs) - modifier byte
+	0x95, 0x01, //   Report Count (1)
+	0x75, 0x08, //   Report Size (8)
+	0x81, 0x01, //   Input (Cnst,Arr,Abs) - reserved byte
+	0x95, 0x06, //   Report Count (6)
+	0x75, 0x08, //   Report Size (8)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x65, //   Logical Maximum (101)
+	0x05, 0x07, //   Usage Page (Keyboard/Keypad)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, 0x65, //   Usage Maximum (101)
+	0x81, 0x00, //   Input (Data,Arr,Abs) - keycodes
+	0xc0, // End Collection
+}
+
+// KeyboardDevice is a Device backed by a USB HID gadget keyboard function.
+type KeyboardDevice struct {
+	DevicePath string
+}
+
+func (d *KeyboardDevice) Path() string {
+	return d.DevicePath
+}
+
+func (d *KeyboardDevice) ReportDescriptor() []byte {
+	return keyboardReportDescriptor
+}
+
+func (d *KeyboardDevice) Decode(data []byte) ([]byte, error) {
+	var message StreamMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, ErrInvalidMessage
+	}
+	if message.Key == "" {
+		return nil, nil
+	}
+
+	message.ParseMessage()
+	report := message.GenerateHID()
+	return report[:], nil
+}
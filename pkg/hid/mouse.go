@@ -0,0 +1,206 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import "encoding/json"
+
+// MouseMessage is an instance of the message to be streamed to the HID
+// mouse device. DX/DY/Wheel are relative deltas as reported by the client's
+// pointing device.
+type MouseMessage struct {
+	Left   bool
+	Right  bool
+	Middle bool
+	DX     int8
+	DY     int8
+	Wheel  int8
+}
+
+// GenerateHID produces a 4-byte USB HID boot mouse report extended with a
+// wheel byte: button byte, relative X, relative Y, wheel.
+func (m *MouseMessage) GenerateHID() [4]byte {
+	var buttons byte
+	if m.Left {
+		buttons |= 0x01
+	}
+	if m.Right {
+		buttons |= 0x02
+	}
+	if m.Middle {
+		buttons |= 0x04
+	}
+
+	return [4]byte{buttons, byte(m.DX), byte(m.DY), byte(m.Wheel)}
+}
+
+// mouseReportDescriptor is the USB HID report descriptor for a relative
+// mouse: three buttons plus relative X/Y/wheel.
+var mouseReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xa1, 0x01, //   Collection (Application)
+	0x09, 0x01, //     Usage (Pointer)
+	0xa1, 0x00, //     Collection (Physical)
+	0x05, 0x09, //       Usage Page (Button)
+	0x19, 0x01, //       Usage Minimum (Button 1)
+	0x29, 0x03, //       Usage Maximum (Button 3)
+	0x15, 0x00, //       Logical Minimum (0)
+	0x25, 0x01, //       Logical Maximum (1)
+	0x95, 0x03, //       Report Count (3)
+	0x75, 0x01, //       Report Size (1)
+	0x81, 0x02, //       Input (Data,Var,Abs) - buttons
+	0x95, 0x01, //       Report Count (1)
+	0x75, 0x05, //       Report Size (5)
+	0x81, 0x01, //       Input (Cnst,Arr,Abs) - padding
+	0x05, 0x01, //       Usage Page (Generic Desktop)
+	0x09, 0x30, //       Usage (X)
+	0x09, 0x31, //       Usage (Y)
+	0x09, 0x38, //       Usage (Wheel)
+	0x15, 0x81, //       Logical Minimum (-127)
+	0x25, 0x7f, //       Logical Maximum (127)
+	0x75, 0x08, //       Report Size (8)
+	0x95, 0x03, //       Report Count (3)
+	0x81, 0x06, //       Input (Data,Var,Rel) - X, Y, wheel
+	0xc0, //     End Collection
+	0xc0, // End Collection
+}
+
+// MouseDevice is a Device backed by a USB HID gadget relative mouse
+// function.
+type MouseDevice struct {
+	DevicePath string
+}
+
+func (d *MouseDevice) Path() string {
+	return d.DevicePath
+}
+
+func (d *MouseDevice) ReportDescriptor() []byte {
+	return mouseReportDescriptor
+}
+
+func (d *MouseDevice) Decode(data []byte) ([]byte, error) {
+	var message MouseMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, ErrInvalidMessage
+	}
+
+	report := message.GenerateHID()
+	return report[:], nil
+}
+
+// PointerMessage carries an absolute cursor position, used instead of
+// MouseMessage when the client can render the video frame and wants the
+// guest cursor pinned to an exact location regardless of guest pointer
+// acceleration or warping.
+type PointerMessage struct {
+	Left   bool
+	Right  bool
+	Middle bool
+	// X and Y are logical coordinates in the range 0..32767, scaled by the
+	// client to the dimensions of the video frame it is rendering.
+	X     uint16
+	Y     uint16
+	Wheel int8
+}
+
+// GenerateHID produces a 6-byte absolute-pointer report: button byte,
+// little-endian X, little-endian Y, wheel.
+func (m *PointerMessage) GenerateHID() [6]byte {
+	var buttons byte
+	if m.Left {
+		buttons |= 0x01
+	}
+	if m.Right {
+		buttons |= 0x02
+	}
+	if m.Middle {
+		buttons |= 0x04
+	}
+
+	return [6]byte{
+		buttons,
+		byte(m.X), byte(m.X >> 8),
+		byte(m.Y), byte(m.Y >> 8),
+		byte(m.Wheel),
+	}
+}
+
+// pointerReportDescriptor is the USB HID report descriptor for an
+// absolute-pointer device: usage page 0x01 (Generic Desktop), usage 0x02
+// (Mouse), with X/Y reported as absolute values in the logical range
+// 0..32767 instead of the relative deltas a regular mouse reports.
+var pointerReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xa1, 0x01, //   Collection (Application)
+	0x09, 0x01, //     Usage (Pointer)
+	0xa1, 0x00, //     Collection (Physical)
+	0x05, 0x09, //       Usage Page (Button)
+	0x19, 0x01, //       Usage Minimum (Button 1)
+	0x29, 0x03, //       Usage Maximum (Button 3)
+	0x15, 0x00, //       Logical Minimum (0)
+	0x25, 0x01, //       Logical Maximum (1)
+	0x95, 0x03, //       Report Count (3)
+	0x75, 0x01, //       Report Size (1)
+	0x81, 0x02, //       Input (Data,Var,Abs) - buttons
+	0x95, 0x01, //       Report Count (1)
+	0x75, 0x05, //       Report Size (5)
+	0x81, 0x01, //       Input (Cnst,Arr,Abs) - padding
+	0x05, 0x01, //       Usage Page (Generic Desktop)
+	0x09, 0x30, //       Usage (X)
+	0x09, 0x31, //       Usage (Y)
+	0x16, 0x00, 0x00, //       Logical Minimum (0)
+	0x26, 0xff, 0x7f, //       Logical Maximum (32767)
+	0x75, 0x10, //       Report Size (16)
+	0x95, 0x02, //       Report Count (2)
+	0x81, 0x02, //       Input (Data,Var,Abs) - absolute X, Y
+	0x05, 0x01, //       Usage Page (Generic Desktop)
+	0x09, 0x38, //       Usage (Wheel)
+	0x15, 0x81, //       Logical Minimum (-127)
+	0x25, 0x7f, //       Logical Maximum (127)
+	0x75, 0x08, //       Report Size (8)
+	0x95, 0x01, //       Report Count (1)
+	0x81, 0x06, //       Input (Data,Var,Rel) - wheel
+	0xc0, //     End Collection
+	0xc0, // End Collection
+}
+
+// PointerDevice is a Device backed by a USB HID gadget absolute-pointer
+// function.
+type PointerDevice struct {
+	DevicePath string
+}
+
+func (d *PointerDevice) Path() string {
+	return d.DevicePath
+}
+
+func (d *PointerDevice) ReportDescriptor() []byte {
+	return pointerReportDescriptor
+}
+
+func (d *PointerDevice) Decode(data []byte) ([]byte, error) {
+	var message PointerMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, ErrInvalidMessage
+	}
+
+	report := message.GenerateHID()
+	return report[:], nil
+}
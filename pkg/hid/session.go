@@ -0,0 +1,70 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"context"
+	"sync"
+)
+
+// sessionHandle identifies a single registered session so release only
+// removes the registry entry if it still belongs to that session, rather
+// than a later session that has since taken over.
+type sessionHandle struct {
+	cancel context.CancelFunc
+}
+
+// sessionRegistry tracks the single active WebsocketHandler session per
+// actor. Browsers routinely leak sessions when tabs are closed or networks
+// flap, so a reconnecting actor supersedes its own orphaned session instead
+// of racing it for the HID gadget.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*sessionHandle
+}
+
+// registry is the process-wide session registry shared by every Stream.
+var registry = &sessionRegistry{sessions: make(map[string]*sessionHandle)}
+
+// takeOver cancels any session already registered for actor, registers a
+// new one, and returns a context that is cancelled when a later session
+// takes over from this one.
+func (r *sessionRegistry) takeOver(actor string) (context.Context, *sessionHandle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if prev, ok := r.sessions[actor]; ok {
+		prev.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handle := &sessionHandle{cancel: cancel}
+	r.sessions[actor] = handle
+	return ctx, handle
+}
+
+// release removes handle from the registry, but only if no later session
+// has already taken over actor's slot.
+func (r *sessionRegistry) release(actor string, handle *sessionHandle) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[actor] == handle {
+		delete(r.sessions, actor)
+	}
+}
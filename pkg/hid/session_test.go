@@ -0,0 +1,79 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package hid
+
+import (
+	"testing"
+	"time"
+)
+
+// TestSessionRegistryTakeOverCancelsPriorSession opens two mock sessions
+// for the same actor and verifies the first session's read loop is
+// cancelled before the second is registered, mirroring what
+// Stream.WebsocketHandler relies on to avoid two tabs racing for the same
+// HID gadget.
+func TestSessionRegistryTakeOverCancelsPriorSession(t *testing.T) {
+	const actor = "https://issuer.example|subject-1"
+	reg := &sessionRegistry{sessions: make(map[string]*sessionHandle)}
+
+	ctx1, handle1 := reg.takeOver(actor)
+	firstCancelled := make(chan struct{})
+	go func() {
+		<-ctx1.Done()
+		close(firstCancelled)
+	}()
+
+	select {
+	case <-firstCancelled:
+		t.Fatal("first session was cancelled before the second one started")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, handle2 := reg.takeOver(actor)
+
+	select {
+	case <-firstCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("first session's context was not cancelled when the second took over")
+	}
+
+	reg.release(actor, handle1)
+	if _, ok := reg.sessions[actor]; !ok {
+		t.Fatal("release of a superseded handle must not remove the current session")
+	}
+
+	reg.release(actor, handle2)
+	if _, ok := reg.sessions[actor]; ok {
+		t.Fatal("release of the current handle should remove the session")
+	}
+}
+
+// TestSessionRegistryTakeOverIndependentActors verifies that sessions for
+// different actors do not interfere with one another.
+func TestSessionRegistryTakeOverIndependentActors(t *testing.T) {
+	reg := &sessionRegistry{sessions: make(map[string]*sessionHandle)}
+
+	ctx1, _ := reg.takeOver("actor-1")
+	_, _ = reg.takeOver("actor-2")
+
+	select {
+	case <-ctx1.Done():
+		t.Fatal("a session for a different actor must not cancel this one")
+	default:
+	}
+}
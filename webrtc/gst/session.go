@@ -0,0 +1,275 @@
+/*
+ * Adsisto
+ * Copyright (c) 2019 Andrew Ying
+ *
+ * This program is free software: you can redistribute it and/or modify it under
+ * the terms of version 3 of the GNU General Public License as published by the
+ * Free Software Foundation. In addition, this program is also subject to certain
+ * additional terms available at <SUPPLEMENT.md>.
+ *
+ * This program is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+ * A PARTICULAR PURPOSE.  See the GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package gst
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v2"
+)
+
+const (
+	videoTrackID  = "video"
+	audioTrackID  = "audio"
+	trackStreamID = "adsisto"
+)
+
+// ErrUnsupportedCodec is returned when a rtcSession is asked to negotiate a
+// codec CreatePipeline does not know how to encode for.
+var ErrUnsupportedCodec = errors.New("unsupported codec")
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// signalMessage is the envelope exchanged over the signaling WebSocket. Only
+// one of SDP or Candidate is ever populated for a given Event.
+type signalMessage struct {
+	Event     string                     `json:"event"`
+	SDP       *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+}
+
+// Session holds the GStreamer pipeline configuration shared by every
+// connection negotiated through SignalingHandler. It carries no
+// per-connection state, so a single Session can be registered once as an
+// http.Handler and safely serve any number of concurrent or successive
+// browser clients.
+type Session struct {
+	// VideoSrc and AudioSrc are GStreamer source bins, e.g. "ximagesrc" or
+	// "pulsesrc device=...", fed into the encoder selected by VideoCodec.
+	VideoSrc   string
+	AudioSrc   string
+	VideoCodec string
+}
+
+// SignalingHandler upgrades the request to a WebSocket used purely as a
+// signaling channel, then drives SDP/ICE negotiation and trickle-ICE for the
+// lifetime of the connection. Each call builds its own rtcSession, so
+// concurrent clients - and a client reconnecting after the previous
+// connection tore down - each get an independent PeerConnection and pipeline
+// set instead of racing over shared state.
+func (s *Session) SignalingHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	rtc := &rtcSession{
+		conn:       conn,
+		videoSrc:   s.VideoSrc,
+		audioSrc:   s.AudioSrc,
+		videoCodec: s.VideoCodec,
+	}
+	defer rtc.teardown()
+
+	if err := rtc.setupPeerConnection(); err != nil {
+		log.Print(err)
+		return
+	}
+
+	for {
+		var msg signalMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			log.Print(err)
+			return
+		}
+
+		switch msg.Event {
+		case "offer":
+			if msg.SDP == nil {
+				continue
+			}
+			if err := rtc.handleOffer(*msg.SDP); err != nil {
+				log.Print(err)
+				return
+			}
+		case "candidate":
+			if msg.Candidate == nil {
+				continue
+			}
+			if err := rtc.pc.AddICECandidate(*msg.Candidate); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// rtcSession ties together a single WebRTC PeerConnection, the GStreamer
+// Pipelines feeding its tracks, and the signaling WebSocket used to
+// negotiate it with a browser client. It is request-scoped: SignalingHandler
+// constructs a new rtcSession for every connection, so it never outlives the
+// negotiation it was created for.
+type rtcSession struct {
+	videoSrc   string
+	audioSrc   string
+	videoCodec string
+
+	mu        sync.Mutex
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	pc        *webrtc.PeerConnection
+	pipelines []*Pipeline
+	closed    bool
+}
+
+// setupPeerConnection creates the PeerConnection, wires VP8/H264/Opus tracks
+// backed by new GStreamer Pipelines, and forwards local ICE candidates over
+// the signaling socket as they trickle in.
+func (s *rtcSession) setupPeerConnection() error {
+	mediaEngine := webrtc.MediaEngine{}
+	mediaEngine.RegisterDefaultCodecs()
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{URLs: []string{"stun:stun.l.google.com:19302"}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	s.pc = pc
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+
+		init := c.ToJSON()
+		s.send(signalMessage{Event: "candidate", Candidate: &init})
+	})
+
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("[INFO] ICE connection state changed to %s", state.String())
+
+		switch state {
+		case webrtc.ICEConnectionStateFailed, webrtc.ICEConnectionStateClosed:
+			s.teardown()
+		}
+	})
+
+	videoCodec := s.videoCodec
+	if videoCodec == "" {
+		videoCodec = webrtc.VP8
+	}
+
+	if err := s.addTrack(videoCodec, videoTrackID, s.videoSrc); err != nil {
+		return err
+	}
+	return s.addTrack(webrtc.Opus, audioTrackID, s.audioSrc)
+}
+
+// addTrack creates a Track for codecName, attaches it to the PeerConnection,
+// and starts a GStreamer Pipeline that writes samples into it.
+func (s *rtcSession) addTrack(codecName, id, src string) error {
+	var track *webrtc.Track
+	var err error
+
+	switch codecName {
+	case webrtc.VP8:
+		track, err = webrtc.NewTrack(webrtc.DefaultPayloadTypeVP8, rand.Uint32(), id, trackStreamID, webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, videoClockRate))
+	case webrtc.H264:
+		track, err = webrtc.NewTrack(webrtc.DefaultPayloadTypeH264, rand.Uint32(), id, trackStreamID, webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, videoClockRate))
+	case webrtc.Opus:
+		track, err = webrtc.NewTrack(webrtc.DefaultPayloadTypeOpus, rand.Uint32(), id, trackStreamID, webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, audioClockRate))
+	default:
+		return ErrUnsupportedCodec
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.pc.AddTrack(track); err != nil {
+		return err
+	}
+
+	pipeline := CreatePipeline(codecName, []*webrtc.Track{track}, src)
+	s.pipelines = append(s.pipelines, pipeline)
+	pipeline.Start()
+
+	return nil
+}
+
+// handleOffer applies a remote SDP offer, answers it, and sends the answer
+// back over the signaling socket.
+func (s *rtcSession) handleOffer(offer webrtc.SessionDescription) error {
+	if err := s.pc.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+
+	if err := s.pc.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	s.send(signalMessage{Event: "answer", SDP: &answer})
+	return nil
+}
+
+// send writes msg to the signaling socket, serialising concurrent writers.
+func (s *rtcSession) send(msg signalMessage) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.conn == nil {
+		return
+	}
+	if err := s.conn.WriteJSON(msg); err != nil {
+		log.Print(err)
+	}
+}
+
+// teardown stops every Pipeline backing this rtcSession and closes the
+// PeerConnection and signaling socket. It is safe to call more than once.
+func (s *rtcSession) teardown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	for _, pipeline := range s.pipelines {
+		pipeline.Stop()
+	}
+
+	if s.pc != nil {
+		if err := s.pc.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if s.conn != nil {
+		if err := s.conn.Close(); err != nil {
+			log.Print(err)
+		}
+	}
+}